@@ -15,6 +15,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	"errors"
 	"flag"
 	"fmt"
@@ -27,6 +28,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 var (
@@ -51,11 +53,32 @@ type env struct {
 	// when building the stdlib, as an optimization for remote execution.
 	sdkzip string
 
+	// sdkarchive is the path to the Go SDK package as a tar, tar.gz, or zip
+	// archive. This is only used when building the stdlib, as an
+	// optimization for remote execution, and supersedes sdkzip when set.
+	sdkarchive string
+
+	// sdkchecksums is the path to a sha256sum(1)-format manifest of expected
+	// digests for the files under sdk/sdkzip/sdkarchive. When set, stdlib
+	// replication verifies every file it writes that the manifest lists.
+	sdkchecksums string
+
 	// installSuffix is the name of the directory below GOROOT/pkg that contains
 	// the .a files for the standard library we should build against.
 	// For example, linux_amd64_race.
 	installSuffix string
 
+	// variants are the additional standard library variants (race, msan,
+	// asan, shared) to build into their own GOROOT/pkg/$suffix tree,
+	// alongside the default build, so go_toolchain can pick the right one at
+	// link time without re-replicating the SDK per variant.
+	variants []stdlibVariant
+
+	// jobs is the maximum number of archive entries extracted concurrently
+	// when replicating the stdlib from an archive. 0 means
+	// runtime.GOMAXPROCS(0).
+	jobs int
+
 	// verbose indicates whether subprocess command lines should be printed.
 	verbose bool
 
@@ -71,13 +94,136 @@ func envFlags(flags *flag.FlagSet) *env {
 	env := &env{}
 	flags.StringVar(&env.sdk, "sdk", "", "Path to the Go SDK.")
 	flags.StringVar(&env.sdkzip, "sdkzip", "", "Path to the Go SDK (as a zip archive)")
+	flags.StringVar(&env.sdkarchive, "sdkarchive", "", "Path to the Go SDK (as a tar, tar.gz, or zip archive)")
+	flags.IntVar(&env.jobs, "jobs", 0, "Maximum number of archive entries to extract concurrently when replicating from -sdkarchive or -sdkzip. 0 means GOMAXPROCS.")
+	flags.StringVar(&env.sdkchecksums, "sdkchecksums", "", "Path to a sha256sum(1)-format manifest of expected digests for the SDK being replicated")
 	flags.Var(&tagFlag{}, "tags", "List of build tags considered true.")
 	flags.StringVar(&env.installSuffix, "installsuffix", "", "Standard library under GOROOT/pkg")
+	flags.Var(&variantFlag{variants: &env.variants}, "variant", "Additional stdlib variant to build alongside the default build (race, msan, asan, shared); may be repeated.")
 	flags.BoolVar(&env.verbose, "v", false, "Whether subprocess command lines should be printed")
 	flags.BoolVar(&env.shouldPreserveWorkDir, "work", false, "if true, the temporary work directory will be preserved")
 	return env
 }
 
+// stdlibVariant names a parallel build of the standard library, built into
+// its own GOROOT/pkg/$suffix tree alongside the default build.
+type stdlibVariant string
+
+const (
+	variantRace   stdlibVariant = "race"
+	variantMSan   stdlibVariant = "msan"
+	variantASan   stdlibVariant = "asan"
+	variantShared stdlibVariant = "shared"
+)
+
+// variantFlag implements flag.Value, accumulating repeated -variant flags
+// into variants.
+type variantFlag struct {
+	variants *[]stdlibVariant
+}
+
+func (f *variantFlag) String() string {
+	if f.variants == nil {
+		return ""
+	}
+	names := make([]string, len(*f.variants))
+	for i, v := range *f.variants {
+		names[i] = string(v)
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *variantFlag) Set(value string) error {
+	switch stdlibVariant(value) {
+	case variantRace, variantMSan, variantASan, variantShared:
+		*f.variants = append(*f.variants, stdlibVariant(value))
+		return nil
+	default:
+		return fmt.Errorf("unknown -variant %q: must be one of race, msan, asan, shared", value)
+	}
+}
+
+// installSuffixForVariant returns the GOROOT/pkg subdirectory name and the
+// extra compiler/linker flags needed to build the standard library for
+// variant, layered on top of the host's default platform install suffix.
+func installSuffixForVariant(platformSuffix string, variant stdlibVariant) (suffix string, goFlags []string) {
+	switch variant {
+	case variantRace:
+		return platformSuffix + "_race", []string{"-race"}
+	case variantMSan:
+		return platformSuffix + "_msan", []string{"-msan"}
+	case variantASan:
+		return platformSuffix + "_asan", []string{"-asan"}
+	case variantShared:
+		return platformSuffix + "_dynlink", []string{"-buildmode=shared"}
+	default:
+		return platformSuffix, nil
+	}
+}
+
+// replicateStdlibVariants assembles a single GOROOT at dst out of src, a Go
+// SDK tree carrying at least a pkg/$suffix tree for the host platform. It
+// replicates the skeleton every variant shares -- bin/, src/, pkg/include,
+// pkg/tool, and the host's own default pkg/$platformSuffix -- exactly once,
+// via hardlinks, then for each of e.variants either overlays that variant's
+// own pkg/$suffix tree, if src already has one cached from an earlier call,
+// or builds it directly into dst. This turns what would otherwise be one
+// Bazel action per requested variant, each re-replicating the entire SDK
+// from scratch, into a single action that shares the skeleton and only
+// builds the variants that aren't already cached.
+func (e *env) replicateStdlibVariants(src, dst, platformSuffix string, options ...replicateOption) error {
+	skeletonPaths := []string{
+		"bin",
+		"src",
+		filepath.Join("pkg", "include"),
+		filepath.Join("pkg", "tool"),
+		filepath.Join("pkg", platformSuffix),
+	}
+	skeletonOptions := append(append([]replicateOption{}, options...), replicatePaths(skeletonPaths...), replicateHardlinked())
+	if err := replicate(src, dst, skeletonOptions...); err != nil {
+		return fmt.Errorf("replicating stdlib skeleton: %v", err)
+	}
+
+	for _, variant := range e.variants {
+		suffix, _ := installSuffixForVariant(platformSuffix, variant)
+		variantSrc := filepath.Join(src, "pkg", suffix)
+		if _, err := os.Stat(variantSrc); err == nil {
+			if err := replicate(variantSrc, filepath.Join(dst, "pkg", suffix), replicateHardlinked()); err != nil {
+				return fmt.Errorf("replicating stdlib variant %s: %v", variant, err)
+			}
+			continue
+		}
+		if err := e.buildStdlibVariant(dst, platformSuffix, variant); err != nil {
+			return fmt.Errorf("building stdlib variant %s: %v", variant, err)
+		}
+	}
+	return nil
+}
+
+// buildStdlibArgs returns the "go install" arguments that build the standard
+// library for variant: installSuffixForVariant's compiler/linker flags
+// (-race, -msan, -asan, or -buildmode=shared), plus the -installsuffix flag
+// that tells the go tool to write the resulting .a files under
+// pkg/$suffix rather than over the default build.
+func buildStdlibArgs(platformSuffix string, variant stdlibVariant) []string {
+	suffix, goFlags := installSuffixForVariant(platformSuffix, variant)
+	args := append(append([]string{}, goFlags...), "-installsuffix", suffix, "std")
+	return args
+}
+
+// buildStdlibVariant builds the standard library for variant against
+// goroot, by invoking the host's go tool with GOROOT pointed at goroot
+// instead of e.sdk, so the resulting pkg/$suffix tree lands inside the
+// GOROOT being assembled rather than the host SDK.
+func (e *env) buildStdlibVariant(goroot, platformSuffix string, variant stdlibVariant) error {
+	args := e.goCmd("install", buildStdlibArgs(platformSuffix, variant)...)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "GOROOT="+goroot)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return runAndLogCommand(cmd, e.verbose)
+}
+
 // checkFlags checks whether env flags were set to valid values. checkFlags
 // should be called after parsing flags.
 func (e *env) checkFlags() error {
@@ -110,6 +256,94 @@ func (e *env) workDir() (path string, cleanup func(), err error) {
 	return e.workDirPath, cleanup, nil
 }
 
+// checksumCache records which replicated files have already had their
+// checksum verified against a given checksums manifest, so that repeated
+// actions checking the same manifest don't re-hash an SDK tree that was
+// already confirmed good. A nil *checksumCache is valid and behaves as
+// empty/no-op, so callers that don't have one can pass it through
+// unconditionally.
+type checksumCache struct {
+	path string
+
+	mu       sync.Mutex
+	verified map[string]string // relative path -> verified sha256 hex digest
+}
+
+// checksumCache returns the checksumCache for e.sdkchecksums, loading any
+// digests recorded by a previous action that verified the same manifest.
+// The cache file is keyed by a hash of the manifest's absolute path and
+// lives in the system temp directory, not e's own work directory: two
+// actions checksumming the same SDK essentially never share a work
+// directory (each gets its own, torn down when that action exits), so
+// keying the cache to workDir would mean no action ever sees another's
+// verified digests, defeating the point of persisting it at all.
+func (e *env) checksumCache() (*checksumCache, error) {
+	if e.sdkchecksums == "" {
+		return nil, nil
+	}
+	abs, err := filepath.Abs(e.sdkchecksums)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256([]byte(abs))
+	c := &checksumCache{
+		path:     filepath.Join(os.TempDir(), fmt.Sprintf("rules_go-sdk-checksums-verified-%x.txt", key)),
+		verified: make(map[string]string),
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		c.verified[fields[1]] = fields[0]
+	}
+	return c, nil
+}
+
+// isVerified reports whether relPath was already confirmed to have digest
+// sum against this cache's manifest.
+func (c *checksumCache) isVerified(relPath, sum string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.verified[relPath] == sum
+}
+
+// markVerified records that relPath was confirmed to have digest sum,
+// appending it to the cache file on disk so later actions can see it. It
+// appends rather than rewriting the whole file, since extraction verifies
+// many files concurrently and a full rewrite per file would serialize
+// that work on one growing write.
+func (c *checksumCache) markVerified(relPath, sum string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.verified[relPath] == sum {
+		return
+	}
+	c.verified[relPath] = sum
+
+	// Best-effort: a failure to persist just means a later action re-hashes
+	// this file, not a correctness issue.
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s\n", sum, relPath)
+}
+
 // goTool returns a slice containing the path to an executable at
 // $GOROOT/pkg/$GOOS_$GOARCH/$tool and additional arguments.
 func (e *env) goTool(tool string, args ...string) []string {
@@ -231,11 +465,30 @@ func abs(path string) string {
 		return path
 	}
 
-	if abs, err := filepath.Abs(path); err != nil {
+	a, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return extendedLengthPath(a)
+}
+
+// extendedLengthPath prepends the Windows `\\?\` extended-length prefix to
+// an already-absolute path when it's long enough to exceed MAX_PATH (260
+// characters, minus the terminating null the Win32 APIs account for
+// themselves), which opts out of MAX_PATH enforcement entirely. It's a
+// no-op on other platforms and on paths short enough to not need it.
+func extendedLengthPath(path string) string {
+	return extendedLengthPathForGOOS(runtime.GOOS, path)
+}
+
+// extendedLengthPathForGOOS is extendedLengthPath's logic, parameterized by
+// GOOS so tests can exercise the Windows-only \\?\ prefixing regardless of
+// the host platform they run on.
+func extendedLengthPathForGOOS(goos, path string) string {
+	if goos != "windows" || len(path) < 260 || strings.HasPrefix(path, `\\?\`) {
 		return path
-	} else {
-		return abs
 	}
+	return `\\?\` + path
 }
 
 // absArgs applies abs to strings that appear in args. Only paths that are
@@ -0,0 +1,258 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInstallSuffixForVariant(t *testing.T) {
+	for _, tc := range []struct {
+		variant     stdlibVariant
+		wantSuffix  string
+		wantGoFlags []string
+	}{
+		{variantRace, "linux_amd64_race", []string{"-race"}},
+		{variantMSan, "linux_amd64_msan", []string{"-msan"}},
+		{variantASan, "linux_amd64_asan", []string{"-asan"}},
+		{variantShared, "linux_amd64_dynlink", []string{"-buildmode=shared"}},
+	} {
+		suffix, goFlags := installSuffixForVariant("linux_amd64", tc.variant)
+		if suffix != tc.wantSuffix {
+			t.Errorf("installSuffixForVariant(%q, %q) suffix = %q, want %q", "linux_amd64", tc.variant, suffix, tc.wantSuffix)
+		}
+		if len(goFlags) != len(tc.wantGoFlags) || (len(goFlags) > 0 && goFlags[0] != tc.wantGoFlags[0]) {
+			t.Errorf("installSuffixForVariant(%q, %q) goFlags = %v, want %v", "linux_amd64", tc.variant, goFlags, tc.wantGoFlags)
+		}
+	}
+}
+
+// buildFakeSDK creates a minimal SDK tree under a temp dir, with a
+// pkg/$platformSuffix tree for the host platform plus one for each variant
+// in withVariants.
+func buildFakeSDK(t *testing.T, platformSuffix string, withVariants []stdlibVariant) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		filepath.Join("bin", "go"):                    "go binary",
+		filepath.Join("src", "runtime", "a.go"):       "package runtime",
+		filepath.Join("pkg", "include", "a.h"):        "header",
+		filepath.Join("pkg", "tool", "compile"):       "compiler",
+		filepath.Join("pkg", platformSuffix, "fmt.a"): "default pkg",
+	}
+	for _, variant := range withVariants {
+		suffix, _ := installSuffixForVariant(platformSuffix, variant)
+		files[filepath.Join("pkg", suffix, "fmt.a")] = "variant pkg: " + string(variant)
+	}
+	for rel, content := range files {
+		full := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestReplicateStdlibVariantsSharesSkeletonAndSelectsVariants(t *testing.T) {
+	const platformSuffix = "linux_amd64"
+	src := buildFakeSDK(t, platformSuffix, []stdlibVariant{variantRace, variantMSan})
+	dst := filepath.Join(t.TempDir(), "goroot")
+
+	e := &env{variants: []stdlibVariant{variantRace}}
+	if err := e.replicateStdlibVariants(src, dst, platformSuffix); err != nil {
+		t.Fatal(err)
+	}
+
+	// The skeleton and the default platform pkg tree should be hardlinked,
+	// not copied: same underlying file as the source.
+	for _, rel := range []string{
+		filepath.Join("bin", "go"),
+		filepath.Join("src", "runtime", "a.go"),
+		filepath.Join("pkg", "include", "a.h"),
+		filepath.Join("pkg", "tool", "compile"),
+		filepath.Join("pkg", platformSuffix, "fmt.a"),
+	} {
+		srcInfo, err := os.Stat(filepath.Join(src, rel))
+		if err != nil {
+			t.Fatalf("stat src %s: %v", rel, err)
+		}
+		dstInfo, err := os.Stat(filepath.Join(dst, rel))
+		if err != nil {
+			t.Fatalf("expected %s to be replicated: %v", rel, err)
+		}
+		if !os.SameFile(srcInfo, dstInfo) {
+			t.Errorf("%s was not hardlinked from the shared skeleton", rel)
+		}
+	}
+
+	raceSuffix, _ := installSuffixForVariant(platformSuffix, variantRace)
+	if _, err := os.Stat(filepath.Join(dst, "pkg", raceSuffix, "fmt.a")); err != nil {
+		t.Errorf("expected requested variant %s to be replicated: %v", variantRace, err)
+	}
+
+	msanSuffix, _ := installSuffixForVariant(platformSuffix, variantMSan)
+	if _, err := os.Stat(filepath.Join(dst, "pkg", msanSuffix)); err == nil {
+		t.Errorf("variant %s was not requested and should not have been replicated", variantMSan)
+	}
+}
+
+func TestExtendedLengthPathForGOOS(t *testing.T) {
+	long := strings.Repeat("a", 260)
+	for _, tc := range []struct {
+		name string
+		goos string
+		path string
+		want string
+	}{
+		{"short path is a no-op", "windows", "/short/path", "/short/path"},
+		{"non-windows is always a no-op, even when long", "linux", long, long},
+		{"long windows path gets prefixed", "windows", long, `\\?\` + long},
+		{"already-prefixed path isn't prefixed twice", "windows", `\\?\` + long, `\\?\` + long},
+	} {
+		if got := extendedLengthPathForGOOS(tc.goos, tc.path); got != tc.want {
+			t.Errorf("%s: extendedLengthPathForGOOS(%q, ...) = %q, want %q", tc.name, tc.goos, got, tc.want)
+		}
+	}
+}
+
+func TestAbs(t *testing.T) {
+	if got := abs("__BAZEL_XCODE_WRAPPED_CLANG"); got != "__BAZEL_XCODE_WRAPPED_CLANG" {
+		t.Errorf(`abs("__BAZEL_XCODE_WRAPPED_CLANG") = %q, want it passed through unchanged`, got)
+	}
+
+	rel := "some/relative/path"
+	want, err := filepath.Abs(rel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := abs(rel); got != want {
+		t.Errorf("abs(%q) = %q, want %q", rel, got, want)
+	}
+}
+
+func TestChecksumCacheReusedAcrossCalls(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "sha256sums.txt")
+	if err := ioutil.WriteFile(manifest, []byte("deadbeef  src/go.mod\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := &env{sdkchecksums: manifest}
+
+	first, err := e.checksumCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(first.path) })
+
+	const relPath, sum = "src/go.mod", "cafef00d"
+	if first.isVerified(relPath, sum) {
+		t.Fatal("a fresh checksumCache should not report anything as verified yet")
+	}
+	first.markVerified(relPath, sum)
+
+	// A second call to checksumCache, simulating a later action checking
+	// the same manifest, should see the digest the first call persisted,
+	// since 2501f25 keys the cache file to the manifest's absolute path
+	// rather than to any one action's work directory.
+	second, err := e.checksumCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.isVerified(relPath, sum) {
+		t.Error("a second checksumCache for the same manifest should have seen the digest markVerified persisted, but didn't")
+	}
+}
+
+func TestReplicateStdlibVariantsBuildsMissingVariant(t *testing.T) {
+	const platformSuffix = "linux_amd64"
+	src := buildFakeSDK(t, platformSuffix, nil)
+	dst := filepath.Join(t.TempDir(), "goroot")
+
+	// src has no cached pkg/linux_amd64_race tree, so replicateStdlibVariants
+	// falls back to building it by invoking the go tool under e.sdk; e.sdk is
+	// unset here, so there is no go executable to run, the build fails, and
+	// the error should surface rather than being swallowed.
+	e := &env{variants: []stdlibVariant{variantRace}}
+	if err := e.replicateStdlibVariants(src, dst, platformSuffix); err == nil {
+		t.Fatal("expected an error when building a requested variant whose pkg tree is missing from src fails")
+	}
+}
+
+func TestBuildStdlibArgs(t *testing.T) {
+	for _, tc := range []struct {
+		variant stdlibVariant
+		want    []string
+	}{
+		{variantRace, []string{"-race", "-installsuffix", "linux_amd64_race", "std"}},
+		{variantMSan, []string{"-msan", "-installsuffix", "linux_amd64_msan", "std"}},
+		{variantASan, []string{"-asan", "-installsuffix", "linux_amd64_asan", "std"}},
+		{variantShared, []string{"-buildmode=shared", "-installsuffix", "linux_amd64_dynlink", "std"}},
+	} {
+		got := buildStdlibArgs("linux_amd64", tc.variant)
+		if len(got) != len(tc.want) {
+			t.Fatalf("buildStdlibArgs(%q, %q) = %v, want %v", "linux_amd64", tc.variant, got, tc.want)
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("buildStdlibArgs(%q, %q)[%d] = %q, want %q", "linux_amd64", tc.variant, i, got[i], tc.want[i])
+			}
+		}
+	}
+}
+
+// writeFakeGoScript writes an executable shell script to dir/bin/go that
+// records its own arguments and the GOROOT it was invoked with into
+// dir/invoked.txt, so tests can assert on what buildStdlibVariant ran
+// without needing a real Go SDK to build against.
+func writeFakeGoScript(t *testing.T, dir string) {
+	t.Helper()
+	goBin := filepath.Join(dir, "bin", "go")
+	if err := os.MkdirAll(filepath.Dir(goBin), 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\n" +
+		"printf 'GOROOT=%s\\nARGS=%s\\n' \"$GOROOT\" \"$*\" > \"$(dirname \"$0\")/../invoked.txt\"\n"
+	if err := ioutil.WriteFile(goBin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildStdlibVariantInvokesGoWithFlags(t *testing.T) {
+	sdk := t.TempDir()
+	writeFakeGoScript(t, sdk)
+	goroot := t.TempDir()
+
+	e := &env{sdk: sdk}
+	if err := e.buildStdlibVariant(goroot, "linux_amd64", variantRace); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(sdk, "invoked.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "GOROOT=" + goroot + "\n" +
+		"ARGS=install -race -installsuffix linux_amd64_race std\n"
+	if string(got) != want {
+		t.Errorf("buildStdlibVariant invoked go with:\n%s\nwant:\n%s", got, want)
+	}
+}
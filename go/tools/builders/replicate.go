@@ -16,12 +16,24 @@
 package main
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
 )
 
 type replicateMode int
@@ -32,13 +44,125 @@ const (
 	softlinkMode
 )
 
+// symlinkPolicy controls how replicate handles symlinks it encounters in
+// src, whether at the root or mid-walk.
+type symlinkPolicy int
+
+const (
+	// preserveSymlinks reproduces every symlink found in src as a symlink in
+	// dst, via os.Symlink, rather than following it. This is the default:
+	// SDKs such as darwin's ship real symlinks under pkg/tool and misc/, and
+	// the toolchain cares about that structure.
+	preserveSymlinks symlinkPolicy = iota
+	// resolveSymlinks reproduces the historical behavior of replicateTree:
+	// only the root of src is resolved to its target via
+	// filepath.EvalSymlinks before replication; symlinks found elsewhere in
+	// the tree are copied as whatever os.Open/os.Stat follows them to.
+	resolveSymlinks
+	// materializeSymlinks dereferences every symlink anywhere in src,
+	// including mid-walk, and replicates the real file or directory it
+	// points to in its place, so dst never contains a symlink.
+	materializeSymlinks
+)
+
 type replicateOption func(*replicateConfig)
 type replicateConfig struct {
 	removeFirst bool
 	fileMode    replicateMode
 	dirMode     replicateMode
 	paths       []string
-	zip         string
+	archive     string
+	moduleAware bool
+	jobs        int
+	checksums   map[string]string
+	cache       *checksumCache
+	symlinks    symlinkPolicy
+
+	// symlinkDepth counts nested materializeSymlinks recursions so a cyclic
+	// symlink (e.g. a directory symlink that points at one of its own
+	// ancestors) fails with an error instead of recursing forever. It's
+	// incremented on a per-call copy of the config by replicateSymlink, not
+	// mutated in place, so sibling symlinks at the same depth don't interfere
+	// with each other.
+	symlinkDepth int
+
+	// checksumRoot is the directory that checksum manifest paths are
+	// relative to. It's set internally by filesystemReplicator; zipReplicator
+	// and tarReplicator don't need it since archive entry names are already
+	// root-relative.
+	checksumRoot string
+}
+
+// prefixTrie matches strings against a fixed set of prefixes in time
+// proportional to the length of the string being matched, rather than the
+// number of prefixes.
+type prefixTrie struct {
+	children map[byte]*prefixTrie
+	terminal bool
+}
+
+// newPrefixTrie builds a prefixTrie recognizing each of prefixes.
+func newPrefixTrie(prefixes []string) *prefixTrie {
+	root := &prefixTrie{children: make(map[byte]*prefixTrie)}
+	for _, prefix := range prefixes {
+		node := root
+		for i := 0; i < len(prefix); i++ {
+			c := prefix[i]
+			child, ok := node.children[c]
+			if !ok {
+				child = &prefixTrie{children: make(map[byte]*prefixTrie)}
+				node.children[c] = child
+			}
+			node = child
+		}
+		node.terminal = true
+	}
+	return root
+}
+
+// hasPrefixOf reports whether any of the prefixes the trie was built from is
+// a prefix of s.
+func (t *prefixTrie) hasPrefixOf(s string) bool {
+	node := t
+	for i := 0; i < len(s); i++ {
+		if node.terminal {
+			return true
+		}
+		child, ok := node.children[s[i]]
+		if !ok {
+			return false
+		}
+		node = child
+	}
+	return node.terminal
+}
+
+// wellKnownModuleManifests are the fixed locations, relative to the root of
+// a Go SDK tree, of the go.mod files that make the standard library and
+// cmd tree buildable in module mode. Not every SDK version ships every
+// file in this list. These are "/"-separated: callers that need an
+// OS-native path (filesystemReplicator) convert with filepath.FromSlash,
+// while archive entry names are always "/"-separated already.
+var wellKnownModuleManifests = []string{
+	"src/go.mod",
+	"src/cmd/go.mod",
+}
+
+// archiveRoot returns the path segment(s) that precede the "src" directory
+// in paths, e.g. "go" for paths like "go/src/pkg/", the layout real upstream
+// go$VERSION.$GOOS-$GOARCH archives use, or "" when paths are already
+// rooted at src itself. All of config.paths are expected to share the same
+// root, so the first path that contains a "src" segment decides it.
+func archiveRoot(paths []string) string {
+	for _, p := range paths {
+		segs := strings.Split(strings.Trim(p, "/"), "/")
+		for i, s := range segs {
+			if s == "src" {
+				return strings.Join(segs[:i], "/")
+			}
+		}
+	}
+	return ""
 }
 
 // replicator implementations are capable to copying a filetree from src to
@@ -54,14 +178,99 @@ func replicatePaths(paths ...string) replicateOption {
 	}
 }
 
-// replicateFromZip is a replicateOption that sets the configuration zip file
-// name.
-func replicateFromZip(zip string) replicateOption {
+// replicateFromArchive is a replicateOption that sets the configuration
+// archive file name. The archive may be a zip file or a tar file, optionally
+// gzip compressed; the concrete format is auto-detected from the file name
+// suffix and, failing that, its magic bytes.
+func replicateFromArchive(archive string) replicateOption {
+	return func(config *replicateConfig) {
+		config.archive = archive
+	}
+}
+
+// replicateModuleAware is a replicateOption that, in addition to the
+// requested paths, also replicates the go.mod and vendor/modules.txt
+// manifests (and any data files named by //go:embed directives in the
+// replicated .go sources) needed to use the destination tree in module mode.
+func replicateModuleAware() replicateOption {
 	return func(config *replicateConfig) {
-		config.zip = zip
+		config.moduleAware = true
 	}
 }
 
+// replicateJobs is a replicateOption that caps the number of archive
+// entries extracted concurrently. A value <= 0 means use
+// runtime.GOMAXPROCS(0).
+func replicateJobs(jobs int) replicateOption {
+	return func(config *replicateConfig) {
+		config.jobs = jobs
+	}
+}
+
+// replicateSymlinkPolicy is a replicateOption that sets how symlinks found
+// in src are handled. The default, if this option isn't used, is
+// preserveSymlinks.
+func replicateSymlinkPolicy(policy symlinkPolicy) replicateOption {
+	return func(config *replicateConfig) {
+		config.symlinks = policy
+	}
+}
+
+// replicateHardlinked is a replicateOption that replicates files via
+// hardlinks instead of copies. It's used to share a single replicated src/
+// tree across multiple stdlib variant builds, each of which writes its own
+// pkg/ output directory on top of that shared skeleton.
+func replicateHardlinked() replicateOption {
+	return func(config *replicateConfig) {
+		config.fileMode = hardlinkMode
+	}
+}
+
+// replicateWithChecksums is a replicateOption that verifies the contents of
+// each replicated file listed in a manifest of expected SHA-256 sums, keyed
+// by path relative to the replication root. Files the manifest doesn't list
+// are replicated unchecked. A mismatch makes replication return an error.
+func replicateWithChecksums(checksums map[string]string) replicateOption {
+	return func(config *replicateConfig) {
+		config.checksums = checksums
+	}
+}
+
+// replicateWithChecksumCache is a replicateOption that skips re-hashing
+// files whose checksum was already confirmed against cache in a previous
+// call, so repeated actions checking the same checksums manifest don't pay
+// to re-verify the same SDK tree.
+func replicateWithChecksumCache(cache *checksumCache) replicateOption {
+	return func(config *replicateConfig) {
+		config.cache = cache
+	}
+}
+
+// parseChecksumManifest reads a checksum manifest in sha256sum(1) format
+// ("<hex digest>  <relative path>" per line, one or two spaces, an optional
+// leading "*" before the path for binary mode) and returns it as a map from
+// slash-separated relative path to lowercase hex digest.
+func parseChecksumManifest(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("malformed checksum manifest line: %q", line)
+		}
+		name := filepath.ToSlash(strings.TrimPrefix(strings.Join(fields[1:], " "), "*"))
+		checksums[name] = strings.ToLower(fields[0])
+	}
+	return checksums, nil
+}
+
 // replicatePrepare is the common preparation steps for a replication entry
 func replicatePrepare(dst string, config *replicateConfig) error {
 	dir := filepath.Dir(dst)
@@ -75,12 +284,24 @@ func replicatePrepare(dst string, config *replicateConfig) error {
 }
 
 // createFile takes a file source reader and FileInfo, creates at file at dst,
-// and updates the file mode.
-func createFile(in io.Reader, stat os.FileInfo, dst string) error {
+// and updates the file mode. If config carries a checksum manifest entry for
+// relPath, the contents are hashed on the fly and verified against it before
+// the mode is applied.
+func createFile(in io.Reader, stat os.FileInfo, dst string, config *replicateConfig, relPath string) error {
 	out, err := os.Create(dst)
 	if err != nil {
 		return err
 	}
+
+	var hasher hash.Hash
+	want, wantChecksum := "", false
+	if config != nil && config.checksums != nil {
+		if want, wantChecksum = config.checksums[relPath]; wantChecksum && !config.cache.isVerified(relPath, want) {
+			hasher = sha256.New()
+			in = io.TeeReader(in, hasher)
+		}
+	}
+
 	_, err = io.Copy(out, in)
 	closeerr := out.Close()
 	if err != nil {
@@ -89,12 +310,33 @@ func createFile(in io.Reader, stat os.FileInfo, dst string) error {
 	if closeerr != nil {
 		return closeerr
 	}
+
+	if hasher != nil {
+		if got := hex.EncodeToString(hasher.Sum(nil)); got != want {
+			return fmt.Errorf("checksum mismatch for %s:\n  expected: %s\n  actual:   %s", relPath, want, got)
+		}
+		config.cache.markVerified(relPath, want)
+	}
+
 	if err := os.Chmod(dst, stat.Mode()); err != nil {
 		return err
 	}
 	return nil
 }
 
+// checksumRelPath returns the key src should be looked up under in
+// config.checksums, relative to config.checksumRoot.
+func checksumRelPath(config *replicateConfig, src string) string {
+	if config.checksumRoot == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(config.checksumRoot, src)
+	if err != nil {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
 // replicateFile is called internally by replicate to map a single file from src into dst.
 func replicateFile(src, dst string, config *replicateConfig) error {
 	if err := replicatePrepare(dst, config); err != nil {
@@ -111,16 +353,53 @@ func replicateFile(src, dst string, config *replicateConfig) error {
 			return err
 		}
 		defer in.Close()
-		return createFile(in, s, dst)
+		return createFile(in, s, dst, config, checksumRelPath(config, src))
 	case hardlinkMode:
+		if err := verifyChecksum(src, config, checksumRelPath(config, src)); err != nil {
+			return err
+		}
 		return os.Link(src, dst)
 	case softlinkMode:
+		if err := verifyChecksum(src, config, checksumRelPath(config, src)); err != nil {
+			return err
+		}
 		return os.Symlink(src, dst)
 	default:
 		return fmt.Errorf("Invalid replication mode %d", config.fileMode)
 	}
 }
 
+// verifyChecksum hashes the file at path and compares it against the
+// expected digest recorded for relPath in config.checksums, if any. It's
+// used by replicateFile's hardlink and softlink modes, which, unlike
+// copyMode, never run the file's bytes through createFile's io.Copy and so
+// would otherwise link straight past a manifest without verifying anything.
+func verifyChecksum(path string, config *replicateConfig, relPath string) error {
+	if config == nil || config.checksums == nil {
+		return nil
+	}
+	want, ok := config.checksums[relPath]
+	if !ok || config.cache.isVerified(relPath, want) {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hasher.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch for %s:\n  expected: %s\n  actual:   %s", relPath, want, got)
+	}
+	config.cache.markVerified(relPath, want)
+	return nil
+}
+
 // replicateDir makes a tree of files visible in a new location.
 // It is allowed to take any efficient method of doing so.
 func replicateDir(src, dst string, config *replicateConfig) error {
@@ -130,14 +409,18 @@ func replicateDir(src, dst string, config *replicateConfig) error {
 	switch config.dirMode {
 	case copyMode:
 		return filepath.Walk(src, func(path string, f os.FileInfo, err error) error {
-			if f.IsDir() {
-				return nil
-			}
 			relative, err := filepath.Rel(src, path)
 			if err != nil {
 				return err
 			}
-			return replicateFile(path, filepath.Join(dst, relative), config)
+			to := filepath.Join(dst, relative)
+			if f.Mode()&os.ModeSymlink != 0 {
+				return replicateSymlink(path, to, config)
+			}
+			if f.IsDir() {
+				return nil
+			}
+			return replicateFile(path, to, config)
 		})
 	case hardlinkMode:
 		return os.Link(src, dst)
@@ -148,15 +431,78 @@ func replicateDir(src, dst string, config *replicateConfig) error {
 	}
 }
 
+// maxSymlinkDepth bounds materializeSymlinks recursion into symlinked
+// directories, matching the ELOOP threshold most Unix kernels enforce for
+// symlink resolution.
+const maxSymlinkDepth = 40
+
+// replicateSymlink reproduces the symlink found at path, which filepath.Walk
+// discovered mid-walk (not at a replicateDir/replicateTree root), at to
+// under dst, honoring config.symlinks.
+func replicateSymlink(path, to string, config *replicateConfig) error {
+	switch config.symlinks {
+	case materializeSymlinks:
+		if config.symlinkDepth >= maxSymlinkDepth {
+			return fmt.Errorf("too many levels of symbolic links materializing %s", path)
+		}
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return err
+		}
+		s, err := os.Stat(real)
+		if err != nil {
+			return err
+		}
+		if s.IsDir() {
+			sub := *config
+			sub.symlinkDepth++
+			return replicateDir(real, to, &sub)
+		}
+		return replicateFile(real, to, config)
+	case resolveSymlinks:
+		// Historical behavior: treat the symlink like any other directory
+		// entry and let os.Open/os.Stat inside replicateFile follow it,
+		// which breaks for a symlink to a directory.
+		return replicateFile(path, to, config)
+	default: // preserveSymlinks
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if err := replicatePrepare(to, config); err != nil {
+			return err
+		}
+		return os.Symlink(target, to)
+	}
+}
+
 func replicateTree(src, dst string, config *replicateConfig) error {
 	if err := os.RemoveAll(dst); err != nil {
 		return fmt.Errorf("Failed to remove file at destination %s: %v", dst, err)
 	}
-	if l, err := filepath.EvalSymlinks(src); err != nil {
+
+	root, err := os.Lstat(src)
+	if err != nil {
 		return err
-	} else {
+	}
+	if root.Mode()&os.ModeSymlink != 0 && config.symlinks == preserveSymlinks {
+		return replicateSymlink(src, dst, config)
+	}
+
+	if config.symlinks != preserveSymlinks {
+		// resolveSymlinks and materializeSymlinks both dereference src
+		// itself before replicating it; materializeSymlinks then continues
+		// to dereference every symlink found mid-walk too, via
+		// replicateDir/replicateSymlink, while resolveSymlinks reproduces
+		// replicateTree's historical behavior of treating the rest of the
+		// tree naively.
+		l, err := filepath.EvalSymlinks(src)
+		if err != nil {
+			return err
+		}
 		src = l
 	}
+
 	if s, err := os.Stat(src); err != nil {
 		return err
 	} else if s.IsDir() {
@@ -178,15 +524,49 @@ func replicate(src, dst string, options ...replicateOption) error {
 	}
 
 	var replicator replicator
-	if config.zip == "" {
+	switch {
+	case config.archive == "":
 		replicator = &filesystemReplicator{}
-	} else {
+	case isTarArchive(config.archive):
+		replicator = &tarReplicator{}
+	default:
 		replicator = &zipReplicator{}
 	}
 
 	return replicator.Replicate(src, dst, &config)
 }
 
+// isTarArchive reports whether archive looks like a tar or tar.gz file,
+// first by its name suffix and, if that's inconclusive, by sniffing its
+// leading bytes. Anything that isn't recognized as tar is treated as a zip
+// archive, preserving the historical default.
+func isTarArchive(archive string) bool {
+	switch {
+	case strings.HasSuffix(archive, ".tar"), strings.HasSuffix(archive, ".tar.gz"), strings.HasSuffix(archive, ".tgz"):
+		return true
+	case strings.HasSuffix(archive, ".zip"):
+		return false
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	// zip local file headers start with "PK\x03\x04"; gzip streams start
+	// with 0x1f 0x8b. Anything else we assume is an uncompressed tar, since
+	// tar has no reliable magic number of its own.
+	if magic[0] == 'P' && magic[1] == 'K' {
+		return false
+	}
+	return true
+}
+
 // filesystemReplicator implements the replicator interface when source paths
 // represent pre-existing entries in the filesystem.
 type filesystemReplicator struct {
@@ -194,6 +574,9 @@ type filesystemReplicator struct {
 
 // Replicate is called for each single src dst pair.
 func (r *filesystemReplicator) Replicate(src, dst string, config *replicateConfig) error {
+	if config.checksums != nil {
+		config.checksumRoot = src
+	}
 	if len(config.paths) == 0 {
 		return replicateTree(src, dst, config)
 	}
@@ -204,9 +587,155 @@ func (r *filesystemReplicator) Replicate(src, dst string, config *replicateConfi
 			return err
 		}
 	}
+	if config.moduleAware {
+		return replicateModuleManifests(src, dst, config)
+	}
+	return nil
+}
+
+// replicateModuleManifests copies the go.mod and vendor/modules.txt files
+// (and any data files named by //go:embed directives in .go files under
+// config.paths) needed to use the tree
+// rooted at dst in module mode, even when they fall outside config.paths.
+func replicateModuleManifests(src, dst string, config *replicateConfig) error {
+	for _, rel := range wellKnownModuleManifests {
+		rel := filepath.FromSlash(rel)
+		from := filepath.Join(src, rel)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if err := replicateFile(from, filepath.Join(dst, rel), config); err != nil {
+			return err
+		}
+	}
+
+	for _, base := range config.paths {
+		root := filepath.Join(src, base)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			switch {
+			case info.Name() == "modules.txt" && filepath.Base(filepath.Dir(path)) == "vendor":
+				rel, err := filepath.Rel(src, path)
+				if err != nil {
+					return err
+				}
+				return replicateFile(path, filepath.Join(dst, rel), config)
+			case strings.HasSuffix(path, ".go"):
+				return replicateEmbeddedFiles(src, dst, path, config)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// replicateEmbeddedFiles copies the data files referenced by //go:embed
+// directives in goFile, which lives under src, into the equivalent location
+// under dst.
+func replicateEmbeddedFiles(src, dst, goFile string, config *replicateConfig) error {
+	patterns, err := goEmbedPatterns(goFile)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(goFile)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(src, match)
+			if err != nil {
+				return err
+			}
+			if err := replicateFile(match, filepath.Join(dst, rel), config); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// goEmbedPatterns scans goFile for //go:embed directives and returns the
+// patterns they declare.
+func goEmbedPatterns(goFile string) ([]string, error) {
+	data, err := ioutil.ReadFile(goFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseGoEmbedPatterns(data), nil
+}
+
+// isModuleManifest reports whether name, a "/"-separated archive entry
+// name, is one of the manifests needed to use the replicated tree in module
+// mode. paths is config.paths: since real SDK archives nest everything
+// under a top-level directory (e.g. "go/src/..."), the well-known manifest
+// locations are anchored under the same root paths already is, rather than
+// assumed to start at the archive root.
+func isModuleManifest(name string, paths []string) bool {
+	root := archiveRoot(paths)
+	for _, manifest := range wellKnownModuleManifests {
+		if name == path.Join(root, manifest) {
+			return true
+		}
+	}
+	return filepath.Base(name) == "modules.txt" && filepath.Base(filepath.Dir(name)) == "vendor"
+}
+
+// zipGoEmbedPatterns scans the zip entry f for //go:embed directives and
+// returns the patterns they declare.
+func zipGoEmbedPatterns(f *zip.File) ([]string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("could not open zip file entry %s: %v", f.Name, err)
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return parseGoEmbedPatterns(data), nil
+}
+
+// archiveEmbedPattern resolves a //go:embed pattern found in the zip or tar
+// entry named goEntryName into a glob matchable against other archive entry
+// names. Archive entry names are always "/"-separated regardless of host
+// OS, so this joins with path, not filepath: filepath.Join would emit a
+// "\"-joined pattern on Windows that never matches a "/"-joined entry name.
+func archiveEmbedPattern(goEntryName, pattern string) string {
+	return path.Join(path.Dir(goEntryName), pattern)
+}
+
+// parseGoEmbedPatterns extracts the arguments of every //go:embed directive
+// found in the given Go source.
+func parseGoEmbedPatterns(src []byte) []string {
+	var patterns []string
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "//go:embed ") {
+			continue
+		}
+		for _, pattern := range strings.Fields(strings.TrimPrefix(line, "//go:embed ")) {
+			// "all:" is a directive modifier, not part of the pattern itself
+			// (it tells the go command to also embed files that would
+			// otherwise be excluded, like those named with a leading "_" or
+			// "."); strip it so the pattern still resolves to the matching
+			// archive entries instead of literally matching nothing.
+			patterns = append(patterns, strings.TrimPrefix(pattern, "all:"))
+		}
+	}
+	return patterns
+}
+
 // zipReplicator implements the replicator interface when source paths represent
 // entries in a zip archive.
 type zipReplicator struct {
@@ -214,7 +743,7 @@ type zipReplicator struct {
 
 // Replicate is called for each single src dst pair.
 func (r *zipReplicator) Replicate(src, dst string, config *replicateConfig) error {
-	in, err := zip.OpenReader(config.zip)
+	in, err := zip.OpenReader(config.archive)
 	if err != nil {
 		return err
 	}
@@ -222,31 +751,94 @@ func (r *zipReplicator) Replicate(src, dst string, config *replicateConfig) erro
 
 	dirs := make(map[string]bool)
 	files := make([]*zip.File, 0)
+	symlinks := make([]*zip.File, 0)
+	selected := make(map[string]bool)
 
-	// Collect all the zipfile entries of interest based on path prefixes in the
-	// config.
-	// TODO: construct a prefix trie here to remove this nested loop
+	addFile := func(f *zip.File) {
+		if selected[f.Name] {
+			return
+		}
+		selected[f.Name] = true
+		switch {
+		case f.FileInfo().IsDir():
+			// Although this check for IsDir is done, in practice the
+			// bazel zipper utility does not create zip directory
+			// entries, so in the usual case this branch is never
+			// executed.
+			dirs[f.Name] = true
+		case f.FileInfo().Mode()&os.ModeSymlink != 0:
+			// Set when the entry was written by a Unix zip tool with its
+			// external attributes carrying a Unix st_mode of S_IFLNK, which
+			// is how SDK archives for darwin and other Unix GOOSes
+			// represent the real symlinks under pkg/tool and misc/.
+			symlinks = append(symlinks, f)
+			dirs[filepath.Dir(f.Name)] = true
+		default:
+			files = append(files, f)
+			dirs[filepath.Dir(f.Name)] = true
+		}
+	}
+
+	// Collect all the zipfile entries of interest based on path prefixes in
+	// the config. A prefix trie lets each entry be matched in O(len(name))
+	// instead of O(len(name) * len(config.paths)).
+	trie := newPrefixTrie(config.paths)
 	for _, f := range in.File {
-		for _, path := range config.paths {
-			if strings.HasPrefix(f.Name, path) {
-				if f.FileInfo().IsDir() {
-					// Although this check for IsDir is done, in practice the
-					// bazel zipper utility does not create zip directory
-					// entries, so in the usual case this branch is never
-					// executed.
-					dirs[f.Name] = true
-				} else {
-					files = append(files, f)
-					dirs[filepath.Dir(f.Name)] = true
+		if trie.hasPrefixOf(f.Name) {
+			addFile(f)
+		}
+	}
+
+	if config.moduleAware {
+		// Module manifests must land in dst even when they fall outside the
+		// requested path prefixes, since the go tool looks for them at fixed
+		// locations regardless of which parts of the tree were replicated.
+		for _, f := range in.File {
+			if isModuleManifest(f.Name, config.paths) {
+				addFile(f)
+			}
+		}
+
+		// Pull in the data files referenced by //go:embed directives in any
+		// .go file we've already selected.
+		var patterns []string
+		for _, f := range files {
+			if !strings.HasSuffix(f.Name, ".go") {
+				continue
+			}
+			ps, err := zipGoEmbedPatterns(f)
+			if err != nil {
+				return err
+			}
+			for _, p := range ps {
+				patterns = append(patterns, archiveEmbedPattern(f.Name, p))
+			}
+		}
+		for _, f := range in.File {
+			if selected[f.Name] {
+				continue
+			}
+			for _, pattern := range patterns {
+				if ok, _ := path.Match(pattern, f.Name); ok {
+					addFile(f)
+					break
 				}
-				break
 			}
 		}
 	}
 
+	var dirOnces sync.Map // dir string -> *sync.Once
+	ensureDir := func(dir string) error {
+		v, _ := dirOnces.LoadOrStore(dir, &sync.Once{})
+		once := v.(*sync.Once)
+		var err error
+		once.Do(func() { err = os.MkdirAll(dir, os.ModePerm) })
+		return err
+	}
+
 	extract := func(file *zip.File) error {
 		to := filepath.Join(dst, file.Name)
-		if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		if err := ensureDir(filepath.Dir(to)); err != nil {
 			return err
 		}
 		f, err := file.Open()
@@ -255,7 +847,31 @@ func (r *zipReplicator) Replicate(src, dst string, config *replicateConfig) erro
 		}
 		defer f.Close()
 
-		return createFile(f, file.FileInfo(), to)
+		return createFile(f, file.FileInfo(), to, config, filepath.ToSlash(file.Name))
+	}
+
+	// extractSymlink reproduces a zip symlink entry, honoring config.symlinks
+	// the same way replicateTarSymlink does for tar archives: the entry's
+	// content is the link target, per the zip convention mirrored from tar.
+	extractSymlink := func(file *zip.File) error {
+		if config.symlinks != preserveSymlinks {
+			return nil
+		}
+		to := filepath.Join(dst, file.Name)
+		if err := ensureDir(filepath.Dir(to)); err != nil {
+			return err
+		}
+		f, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("could not open zip file entry %s: %v", file.Name, err)
+		}
+		defer f.Close()
+		target, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(to)
+		return os.Symlink(string(target), to)
 	}
 
 	for dir := range dirs {
@@ -265,11 +881,189 @@ func (r *zipReplicator) Replicate(src, dst string, config *replicateConfig) erro
 		}
 	}
 
+	jobs := config.jobs
+	if jobs <= 0 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+	var g errgroup.Group
+	sem := make(chan struct{}, jobs)
 	for _, f := range files {
-		if err := extract(f); err != nil {
+		f := f
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			return extract(f)
+		})
+	}
+	for _, f := range symlinks {
+		f := f
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			return extractSymlink(f)
+		})
+	}
+
+	return g.Wait()
+}
+
+// tarReplicator implements the replicator interface when source paths
+// represent entries in a tar archive, transparently gunzipping when the
+// archive is compressed.
+type tarReplicator struct {
+}
+
+// Replicate is called for each single src dst pair.
+func (r *tarReplicator) Replicate(src, dst string, config *replicateConfig) error {
+	selected, err := tarSelectedEntries(config)
+	if err != nil {
+		return err
+	}
+
+	return walkTarEntries(config.archive, func(hdr *tar.Header, tr *tar.Reader) error {
+		if !selected[hdr.Name] {
+			return nil
+		}
+
+		to := filepath.Join(dst, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			return os.MkdirAll(to, os.ModePerm)
+		case tar.TypeSymlink:
+			return replicateTarSymlink(hdr, to, config)
+		default:
+			if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+				return err
+			}
+			if err := createFile(tr, hdr.FileInfo(), to, config, filepath.ToSlash(hdr.Name)); err != nil {
+				return fmt.Errorf("could not extract tar file entry %s: %v", hdr.Name, err)
+			}
+			return nil
+		}
+	})
+}
+
+// walkTarEntries opens archive as a tar stream, transparently gunzipping
+// when it's compressed, and invokes fn with the header of each entry in
+// turn. fn may read the entry's content from tr before returning, the same
+// way tar.Reader works for any single forward pass.
+func walkTarEntries(archive string, fn func(hdr *tar.Header, tr *tar.Reader) error) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var in io.Reader = br
+	magic, _ := br.Peek(2)
+	isGzip := len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b
+	if strings.HasSuffix(archive, ".gz") || strings.HasSuffix(archive, ".tgz") || isGzip {
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("could not open %s as gzip: %v", archive, err)
+		}
+		defer gzr.Close()
+		in = gzr
+	}
+
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read tar entry: %v", err)
+		}
+		if err := fn(hdr, tr); err != nil {
 			return err
 		}
 	}
+}
 
-	return nil
+// tarSelectedEntries determines which entries of config.archive extraction
+// should select: those under config.paths, plus, when config.moduleAware,
+// the module manifests and any //go:embed data files they need. This
+// mirrors the selection zipReplicator does against its in-memory central
+// directory, but as an explicit pre-pass over the whole stream: a tar
+// archive, unlike a zip file, offers no random access to its entry list, so
+// the archive has to be walked once to find out what module-aware
+// replication needs before it's walked again to extract it.
+func tarSelectedEntries(config *replicateConfig) (map[string]bool, error) {
+	selected := make(map[string]bool)
+	var names []string
+	goFiles := make(map[string][]byte)
+
+	err := walkTarEntries(config.archive, func(hdr *tar.Header, tr *tar.Reader) error {
+		names = append(names, hdr.Name)
+
+		matched := false
+		for _, p := range config.paths {
+			if strings.HasPrefix(hdr.Name, p) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			selected[hdr.Name] = true
+		}
+
+		if !config.moduleAware {
+			return nil
+		}
+		if isModuleManifest(hdr.Name, config.paths) {
+			selected[hdr.Name] = true
+		}
+		if matched && strings.HasSuffix(hdr.Name, ".go") {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			goFiles[hdr.Name] = data
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !config.moduleAware {
+		return selected, nil
+	}
+
+	var patterns []string
+	for name, data := range goFiles {
+		for _, p := range parseGoEmbedPatterns(data) {
+			patterns = append(patterns, archiveEmbedPattern(name, p))
+		}
+	}
+	for _, name := range names {
+		if selected[name] {
+			continue
+		}
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				selected[name] = true
+				break
+			}
+		}
+	}
+	return selected, nil
+}
+
+// replicateTarSymlink reproduces a tar symlink entry at to, honoring
+// config.symlinks. Unlike a filesystem walk, a tar stream has no real
+// directory to recurse into for materializeSymlinks: the entry's target, if
+// archived at all, is replicated by its own tar entry elsewhere in the
+// stream, so materializeSymlinks and resolveSymlinks both just drop the
+// link rather than reproduce it.
+func replicateTarSymlink(hdr *tar.Header, to string, config *replicateConfig) error {
+	if config.symlinks != preserveSymlinks {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+	_ = os.Remove(to)
+	return os.Symlink(hdr.Linkname, to)
 }
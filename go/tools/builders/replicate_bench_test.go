@@ -0,0 +1,108 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildBenchmarkSDKZip synthesizes a zip archive shaped like the src/ tree of
+// a real Go SDK distribution (go/src/pkgNNN/fileN.go), with enough entries
+// that extraction cost
+// is dominated by the same per-file overhead a real go$VERSION.$GOOS-$GOARCH
+// archive exercises.
+func buildBenchmarkSDKZip(b *testing.B) string {
+	b.Helper()
+	dir, err := ioutil.TempDir("", "replicate_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "go.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	const packages = 200
+	const filesPerPackage = 5
+	for p := 0; p < packages; p++ {
+		for i := 0; i < filesPerPackage; i++ {
+			name := fmt.Sprintf("go/src/pkg%03d/file%d.go", p, i)
+			entry, err := w.Create(name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := entry.Write([]byte(fmt.Sprintf("package pkg%03d\n", p))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// runZipReplicatorExtractBenchmark extracts buildBenchmarkSDKZip's archive
+// b.N times with jobs concurrent extractions per run (jobs <= 0 means
+// runtime.GOMAXPROCS(0), replicateJobs' own default), so the serial and
+// parallel sub-benchmarks below are identical except for that one knob.
+func runZipReplicatorExtractBenchmark(b *testing.B, jobs int) {
+	archive := buildBenchmarkSDKZip(b)
+	dst, err := ioutil.TempDir("", "replicate_bench_dst")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	r := &zipReplicator{}
+	config := &replicateConfig{
+		removeFirst: true,
+		paths:       []string{"go/src/"},
+		archive:     archive,
+		jobs:        jobs,
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out := filepath.Join(dst, fmt.Sprintf("run%d", i))
+		if err := r.Replicate(archive, out, config); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkZipReplicatorExtractSerial is the pre-parallelization baseline:
+// one entry extracted at a time.
+func BenchmarkZipReplicatorExtractSerial(b *testing.B) {
+	runZipReplicatorExtractBenchmark(b, 1)
+}
+
+// BenchmarkZipReplicatorExtractParallel extracts with the prefix-trie
+// selection and worker pool's default concurrency (GOMAXPROCS), to be
+// compared against BenchmarkZipReplicatorExtractSerial as proof the
+// parallelization is actually faster.
+func BenchmarkZipReplicatorExtractParallel(b *testing.B) {
+	runZipReplicatorExtractBenchmark(b, 0)
+}
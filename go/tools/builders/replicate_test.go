@@ -0,0 +1,580 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveEmbedPattern(t *testing.T) {
+	for _, tc := range []struct {
+		goEntryName, pattern, want string
+	}{
+		{"go/src/pkg/data.go", "testdata/*.txt", "go/src/pkg/testdata/*.txt"},
+		{"pkg/data.go", "data.bin", "pkg/data.bin"},
+	} {
+		if got := archiveEmbedPattern(tc.goEntryName, tc.pattern); got != tc.want {
+			t.Errorf("archiveEmbedPattern(%q, %q) = %q, want %q", tc.goEntryName, tc.pattern, got, tc.want)
+		}
+	}
+}
+
+func TestParseGoEmbedPatternsStripsAllPrefix(t *testing.T) {
+	src := []byte("package pkg\n\n//go:embed all:static data.bin\n//go:embed other/*.txt\nvar fs embed.FS\n")
+	want := []string{"static", "data.bin", "other/*.txt"}
+	got := parseGoEmbedPatterns(src)
+	if len(got) != len(want) {
+		t.Fatalf("parseGoEmbedPatterns() = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("parseGoEmbedPatterns()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+// buildModuleAwareTarGz synthesizes a tar.gz archive shaped like a module-
+// aware Go SDK tree: a go.mod outside the replicated path, and, inside it, a
+// .go file with a //go:embed directive plus the data file it references.
+func buildModuleAwareTarGz(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "go.tar.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gzw := gzip.NewWriter(f)
+	defer gzw.Close()
+	tw := tar.NewWriter(gzw)
+	defer tw.Close()
+
+	entries := map[string]string{
+		"go/src/go.mod":        "module std\n",
+		"go/src/pkg/embed.go":  "package pkg\n\n//go:embed data.txt\nvar data string\n",
+		"go/src/pkg/data.txt":  "hello\n",
+		"go/src/other/skip.go": "package other\n",
+	}
+	for name, content := range entries {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestTarReplicatorModuleAware(t *testing.T) {
+	archive := buildModuleAwareTarGz(t)
+	dst := t.TempDir()
+
+	config := &replicateConfig{
+		removeFirst: true,
+		paths:       []string{"go/src/pkg/"},
+		archive:     archive,
+		moduleAware: true,
+	}
+	r := &tarReplicator{}
+	if err := r.Replicate(archive, dst, config); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"go/src/go.mod", "go/src/pkg/embed.go", "go/src/pkg/data.txt"} {
+		if _, err := os.Stat(filepath.Join(dst, want)); err != nil {
+			t.Errorf("expected %s to be replicated: %v", want, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "go/src/other/skip.go")); err == nil {
+		t.Errorf("go/src/other/skip.go should not have been replicated")
+	}
+}
+
+// buildModuleAwareZip synthesizes a zip archive with the same layout as
+// buildModuleAwareTarGz, nesting everything under a top-level "go/"
+// directory the way real go$VERSION.$GOOS-$GOARCH.zip archives do.
+func buildModuleAwareZip(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "go.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	defer w.Close()
+
+	entries := map[string]string{
+		"go/src/go.mod":        "module std\n",
+		"go/src/pkg/embed.go":  "package pkg\n\n//go:embed data.txt\nvar data string\n",
+		"go/src/pkg/data.txt":  "hello\n",
+		"go/src/other/skip.go": "package other\n",
+	}
+	for name, content := range entries {
+		entry, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := entry.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestZipReplicatorModuleAware(t *testing.T) {
+	archive := buildModuleAwareZip(t)
+	dst := t.TempDir()
+
+	config := &replicateConfig{
+		removeFirst: true,
+		paths:       []string{"go/src/pkg/"},
+		archive:     archive,
+		moduleAware: true,
+	}
+	r := &zipReplicator{}
+	if err := r.Replicate(archive, dst, config); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"go/src/go.mod", "go/src/pkg/embed.go", "go/src/pkg/data.txt"} {
+		if _, err := os.Stat(filepath.Join(dst, want)); err != nil {
+			t.Errorf("expected %s to be replicated: %v", want, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "go/src/other/skip.go")); err == nil {
+		t.Errorf("go/src/other/skip.go should not have been replicated")
+	}
+}
+
+func TestReplicateTreePreservesSymlinkRoot(t *testing.T) {
+	base := t.TempDir()
+	real := filepath.Join(base, "real")
+	if err := os.Mkdir(real, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(real, "f"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+	if err := os.Symlink(real, root); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(base, "dst")
+	config := &replicateConfig{removeFirst: true}
+	if err := replicateTree(root, dst, config); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("replicateTree with the default preserveSymlinks policy should have reproduced %s as a symlink, got %v", dst, fi.Mode())
+	}
+	target, err := os.Readlink(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != real {
+		t.Errorf("replicateTree reproduced %s pointing at %q, want %q", dst, target, real)
+	}
+}
+
+func TestReplicateTreeResolveSymlinksRoot(t *testing.T) {
+	base := t.TempDir()
+	real := filepath.Join(base, "real")
+	if err := os.Mkdir(real, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(real, "f"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+	if err := os.Symlink(real, root); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(base, "dst")
+	config := &replicateConfig{removeFirst: true, symlinks: resolveSymlinks}
+	if err := replicateTree(root, dst, config); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		t.Fatalf("replicateTree with resolveSymlinks should have dereferenced the root %s into a real directory, got %v", dst, fi.Mode())
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dst, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "x" {
+		t.Errorf("replicateTree with resolveSymlinks copied %q, want %q", got, "x")
+	}
+}
+
+func TestReplicateDirMaterializesSymlinks(t *testing.T) {
+	base := t.TempDir()
+	realDir := filepath.Join(base, "realdir")
+	if err := os.Mkdir(realDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(realDir, "f"), []byte("dir-target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	realFile := filepath.Join(base, "realfile")
+	if err := ioutil.WriteFile(realFile, []byte("file-target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(base, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(realDir, filepath.Join(src, "linkdir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(realFile, filepath.Join(src, "linkfile")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(base, "dst")
+	config := &replicateConfig{removeFirst: true, symlinks: materializeSymlinks}
+	if err := replicateDir(src, dst, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Lstat(filepath.Join(dst, "linkdir")); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("materializeSymlinks should have replaced linkdir with a real directory, got %v", fi.Mode())
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dst, "linkdir", "f")); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "dir-target" {
+		t.Errorf("linkdir/f = %q, want %q", got, "dir-target")
+	}
+
+	if fi, err := os.Lstat(filepath.Join(dst, "linkfile")); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("materializeSymlinks should have replaced linkfile with a real file, got %v", fi.Mode())
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dst, "linkfile")); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "file-target" {
+		t.Errorf("linkfile = %q, want %q", got, "file-target")
+	}
+}
+
+func TestReplicateDirMaterializeSymlinksRejectsCycle(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A directory symlink that points back at its own parent: walking into
+	// it and materializing it again recurses forever without the
+	// symlinkDepth guard in replicateSymlink.
+	if err := os.Symlink(src, filepath.Join(src, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(base, "dst")
+	config := &replicateConfig{removeFirst: true, symlinks: materializeSymlinks}
+	err := replicateDir(src, dst, config)
+	if err == nil {
+		t.Fatal("expected replicateDir to fail on a cyclic directory symlink, but it succeeded")
+	}
+}
+
+// buildSymlinkZip synthesizes a zip archive containing a regular file and a
+// symlink entry pointing at it, the way Unix zip tools (and the SDK
+// archives they produce for pkg/tool and misc/) represent symlinks: an
+// external attribute Unix mode of S_IFLNK, with the entry's content being
+// the link target.
+func buildSymlinkZip(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "go.zip")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	defer w.Close()
+
+	fileEntry, err := w.Create("go/misc/real")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fileEntry.Write([]byte("target contents")); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := &zip.FileHeader{Name: "go/misc/link", Method: zip.Store}
+	hdr.SetMode(os.ModeSymlink | 0777)
+	linkEntry, err := w.CreateHeader(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := linkEntry.Write([]byte("real")); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+func TestZipReplicatorSymlinkEntry(t *testing.T) {
+	archive := buildSymlinkZip(t)
+	dst := t.TempDir()
+
+	config := &replicateConfig{
+		removeFirst: true,
+		paths:       []string{"go/misc/"},
+		archive:     archive,
+	}
+	r := &zipReplicator{}
+	if err := r.Replicate(archive, dst, config); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(dst, "go/misc/link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected go/misc/link to be replicated as a symlink, got %v", fi.Mode())
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "go/misc/link")); err != nil {
+		t.Fatal(err)
+	} else if target != "real" {
+		t.Errorf("go/misc/link -> %q, want %q", target, "real")
+	}
+}
+
+func TestZipReplicatorSymlinkEntrySkippedWhenNotPreserving(t *testing.T) {
+	archive := buildSymlinkZip(t)
+	dst := t.TempDir()
+
+	config := &replicateConfig{
+		removeFirst: true,
+		paths:       []string{"go/misc/"},
+		archive:     archive,
+		symlinks:    materializeSymlinks,
+	}
+	r := &zipReplicator{}
+	if err := r.Replicate(archive, dst, config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "go/misc/link")); err == nil {
+		t.Errorf("go/misc/link should not have been extracted under a non-preserving symlink policy")
+	}
+}
+
+// buildSymlinkTarGz synthesizes a tar.gz archive containing a tar.TypeSymlink
+// entry, the way upstream go$VERSION.$GOOS-$GOARCH.tar.gz archives represent
+// the real symlinks under pkg/tool and misc/.
+func buildSymlinkTarGz(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "go.tar.gz")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gzw := gzip.NewWriter(f)
+	defer gzw.Close()
+	tw := tar.NewWriter(gzw)
+	defer tw.Close()
+
+	if err := tw.WriteHeader(&tar.Header{Name: "go/misc/link", Typeflag: tar.TypeSymlink, Linkname: "real", Mode: 0777}); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+func TestTarReplicatorSymlinkEntry(t *testing.T) {
+	archive := buildSymlinkTarGz(t)
+	dst := t.TempDir()
+
+	config := &replicateConfig{
+		removeFirst: true,
+		paths:       []string{"go/misc/"},
+		archive:     archive,
+	}
+	r := &tarReplicator{}
+	if err := r.Replicate(archive, dst, config); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(dst, "go/misc/link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected go/misc/link to be replicated as a symlink, got %v", fi.Mode())
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "go/misc/link")); err != nil {
+		t.Fatal(err)
+	} else if target != "real" {
+		t.Errorf("go/misc/link -> %q, want %q", target, "real")
+	}
+}
+
+func TestTarReplicatorSymlinkEntrySkippedWhenNotPreserving(t *testing.T) {
+	archive := buildSymlinkTarGz(t)
+	dst := t.TempDir()
+
+	config := &replicateConfig{
+		removeFirst: true,
+		paths:       []string{"go/misc/"},
+		archive:     archive,
+		symlinks:    materializeSymlinks,
+	}
+	r := &tarReplicator{}
+	if err := r.Replicate(archive, dst, config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "go/misc/link")); err == nil {
+		t.Errorf("go/misc/link should not have been extracted under a non-preserving symlink policy")
+	}
+}
+
+func TestReplicateFileHardlinkRejectsBadChecksum(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "src")
+	if err := ioutil.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(base, "dst")
+
+	config := &replicateConfig{
+		fileMode:     hardlinkMode,
+		checksums:    map[string]string{"src": "0000000000000000000000000000000000000000000000000000000000000000"},
+		checksumRoot: base,
+	}
+	if err := replicateFile(src, dst, config); err == nil {
+		t.Fatal("replicateFile with hardlinkMode and a mismatched checksum should have failed, but succeeded")
+	}
+	if _, err := os.Stat(dst); err == nil {
+		t.Fatal("replicateFile should not have linked dst after a checksum mismatch")
+	}
+}
+
+func TestParseChecksumManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "sha256sums.txt")
+	content := "" +
+		"1111111111111111111111111111111111111111111111111111111111111111  src/go.mod\n" +
+		"2222222222222222222222222222222222222222222222222222222222222222 *src/cmd/go.mod\n" +
+		"\n"
+	if err := ioutil.WriteFile(manifest, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checksums, err := parseChecksumManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"src/go.mod":     "1111111111111111111111111111111111111111111111111111111111111111",
+		"src/cmd/go.mod": "2222222222222222222222222222222222222222222222222222222222222222",
+	}
+	for name, sum := range want {
+		if checksums[name] != sum {
+			t.Errorf("checksums[%q] = %q, want %q", name, checksums[name], sum)
+		}
+	}
+	if len(checksums) != len(want) {
+		t.Errorf("parseChecksumManifest returned %d entries, want %d: %v", len(checksums), len(want), checksums)
+	}
+}
+
+func TestParseChecksumManifestRejectsMalformedLine(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "sha256sums.txt")
+	if err := ioutil.WriteFile(manifest, []byte("not-a-valid-line\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseChecksumManifest(manifest); err == nil {
+		t.Fatal("parseChecksumManifest should have rejected a line with no path field, but succeeded")
+	}
+}
+
+func TestCreateFileCopyModeCatchesChecksumMismatch(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "src")
+	if err := ioutil.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(base, "dst")
+
+	config := &replicateConfig{
+		checksums:    map[string]string{"src": "0000000000000000000000000000000000000000000000000000000000000000"},
+		checksumRoot: base,
+	}
+	if err := replicateFile(src, dst, config); err == nil {
+		t.Fatal("replicateFile copying a file with a mismatched checksum should have failed, but succeeded")
+	}
+}
+
+func TestCreateFileCopyModeAcceptsMatchingChecksum(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "src")
+	if err := ioutil.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(base, "dst")
+
+	sum := sha256.Sum256([]byte("hello"))
+	config := &replicateConfig{
+		checksums:    map[string]string{"src": hex.EncodeToString(sum[:])},
+		checksumRoot: base,
+	}
+	if err := replicateFile(src, dst, config); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("replicateFile copied %q, want %q", got, "hello")
+	}
+}